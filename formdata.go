@@ -4,71 +4,339 @@ package formdata
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"os"
+	"regexp"
 	"strings"
+	"text/template"
+	"time"
 )
 
 // Config the plugin configuration.
 type Config struct {
-	// Set: create or update form values
+	// Set: create or update form values. Values may contain text/template
+	// expressions evaluated per-request against the incoming request, e.g.
+	// "{{ .Path }}", "{{ .RemoteAddr }}", "{{ .Query.foo }}",
+	// "{{ .Header.X-Request-Id }}", or "{{ .Now \"2006-01-02\" }}". A value
+	// that fails to parse or execute as a template is used as-is, so a
+	// literal "{{" must be escaped (e.g. "{{ \"{{\" }}") to appear unexpanded.
 	Set map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
-	// Append: add additional form values (does not replace)
+	// Append: add additional form values (does not replace). Supports the
+	// same template expansion as Set.
 	Append map[string]string `json:"append,omitempty" yaml:"append,omitempty"`
 	// Delete: list of form keys to remove
 	Delete []string `json:"delete,omitempty" yaml:"delete,omitempty"`
+	// Streaming: rewrite multipart/form-data bodies part-by-part instead of
+	// buffering the whole request in memory. Defaults to true.
+	Streaming bool `json:"streaming,omitempty" yaml:"streaming,omitempty"`
+	// DeleteFiles: list of file field names to remove
+	DeleteFiles []string `json:"deleteFiles,omitempty" yaml:"deleteFiles,omitempty"`
+	// SetFiles: replace all files for a field with a single synthesized file
+	SetFiles map[string]FileSpec `json:"setFiles,omitempty" yaml:"setFiles,omitempty"`
+	// AppendFiles: add an additional file part for a field (does not replace)
+	AppendFiles map[string]FileSpec `json:"appendFiles,omitempty" yaml:"appendFiles,omitempty"`
+	// QuerySet: create or update URL query parameters
+	QuerySet map[string]string `json:"querySet,omitempty" yaml:"querySet,omitempty"`
+	// QueryAppend: add additional URL query parameters (does not replace)
+	QueryAppend map[string]string `json:"queryAppend,omitempty" yaml:"queryAppend,omitempty"`
+	// QueryDelete: list of URL query parameter keys to remove
+	QueryDelete []string `json:"queryDelete,omitempty" yaml:"queryDelete,omitempty"`
+	// Mirror: also apply Set, Append, and Delete to the URL query string
+	Mirror bool `json:"mirror,omitempty" yaml:"mirror,omitempty"`
+	// MaxMemory: bytes of a multipart body kept in memory before the request is
+	// rejected with 413, in the non-streaming path. Defaults to 32<<20 (32MiB).
+	MaxMemory int64 `json:"maxMemory,omitempty" yaml:"maxMemory,omitempty"`
+	// MaxFileSize: per-file hard ceiling, in bytes. Exceeding it rejects the
+	// request with 413. Zero means unlimited. Setting this forces the
+	// buffered (non-streaming) handling of multipart bodies even when
+	// Streaming is true, since the ceiling can only be enforced with a clean
+	// 413 before the request reaches the next handler.
+	MaxFileSize int64 `json:"maxFileSize,omitempty" yaml:"maxFileSize,omitempty"`
+	// MaxBodySize: overall request body ceiling, in bytes, enforced via
+	// http.MaxBytesReader before any parsing. Zero means unlimited.
+	MaxBodySize int64 `json:"maxBodySize,omitempty" yaml:"maxBodySize,omitempty"`
+}
+
+// FileSpec describes a file part to inject via SetFiles or AppendFiles.
+type FileSpec struct {
+	// Path: read the file content from disk at request time
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	// Filename: the filename reported in the part's Content-Disposition
+	Filename string `json:"filename,omitempty" yaml:"filename,omitempty"`
+	// ContentType: the part's Content-Type header; defaults to application/octet-stream
+	ContentType string `json:"contentType,omitempty" yaml:"contentType,omitempty"`
+	// Inline: literal file content; takes precedence over Path when set
+	Inline []byte `json:"inline,omitempty" yaml:"inline,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		Set:    make(map[string]string),
-		Append: make(map[string]string),
-		Delete: []string{},
+		Set:         make(map[string]string),
+		Append:      make(map[string]string),
+		Delete:      []string{},
+		Streaming:   true,
+		DeleteFiles: []string{},
+		SetFiles:    make(map[string]FileSpec),
+		AppendFiles: make(map[string]FileSpec),
+		QuerySet:    make(map[string]string),
+		QueryAppend: make(map[string]string),
+		QueryDelete: []string{},
+		MaxMemory:   32 << 20,
 	}
 }
 
 // Formdata represents the formdata plugin.
 type Formdata struct {
-	next     http.Handler
-	set      map[string]string
-	appendTo map[string]string
-	delete   []string
-	name     string
+	next          http.Handler
+	set           map[string]string
+	appendTo      map[string]string
+	delete        []string
+	deleteSet     map[string]bool
+	streaming     bool
+	deleteFileSet map[string]bool
+	setFiles      map[string]FileSpec
+	appendFiles   map[string]FileSpec
+	querySet      map[string]string
+	queryAppend   map[string]string
+	queryDelete   []string
+	mirror        bool
+	maxMemory     int64
+	maxFileSize   int64
+	maxBodySize   int64
+	name          string
+}
+
+// validateFileSpecs checks that every FileSpec in specs is usable: each must
+// set Inline or a Path that stats cleanly. Catching a bad Path or an empty
+// spec here, at construction time, means a misconfigured SetFiles/AppendFiles
+// entry fails the same way regardless of whether Streaming routes a given
+// request through the buffered or the streaming path.
+func validateFileSpecs(kind string, specs map[string]FileSpec) error {
+	for field, spec := range specs {
+		if spec.Inline != nil {
+			continue
+		}
+		if spec.Path == "" {
+			return fmt.Errorf("%s[%q]: one of path or inline must be set", kind, field)
+		}
+		if _, err := os.Stat(spec.Path); err != nil {
+			return fmt.Errorf("%s[%q]: %v", kind, field, err)
+		}
+	}
+	return nil
 }
 
 // New created a new Formdata plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if len(config.Set) == 0 && len(config.Append) == 0 && len(config.Delete) == 0 {
-		return nil, fmt.Errorf("at least one of set, append, or delete must be provided")
+	if len(config.Set) == 0 && len(config.Append) == 0 && len(config.Delete) == 0 &&
+		len(config.DeleteFiles) == 0 && len(config.SetFiles) == 0 && len(config.AppendFiles) == 0 &&
+		len(config.QuerySet) == 0 && len(config.QueryAppend) == 0 && len(config.QueryDelete) == 0 && !config.Mirror {
+		return nil, fmt.Errorf("at least one of set, append, delete, deleteFiles, setFiles, appendFiles, querySet, queryAppend, queryDelete, or mirror must be provided")
+	}
+
+	if err := validateFileSpecs("setFiles", config.SetFiles); err != nil {
+		return nil, err
+	}
+	if err := validateFileSpecs("appendFiles", config.AppendFiles); err != nil {
+		return nil, err
+	}
+
+	deleteSet := make(map[string]bool, len(config.Delete))
+	for _, k := range config.Delete {
+		deleteSet[k] = true
+	}
+
+	deleteFileSet := make(map[string]bool, len(config.DeleteFiles))
+	for _, k := range config.DeleteFiles {
+		deleteFileSet[k] = true
 	}
 
 	return &Formdata{
-		set:      config.Set,
-		appendTo: config.Append,
-		delete:   config.Delete,
-		next:     next,
-		name:     name,
+		set:           config.Set,
+		appendTo:      config.Append,
+		delete:        config.Delete,
+		deleteSet:     deleteSet,
+		streaming:     config.Streaming,
+		deleteFileSet: deleteFileSet,
+		setFiles:      config.SetFiles,
+		appendFiles:   config.AppendFiles,
+		querySet:      config.QuerySet,
+		queryAppend:   config.QueryAppend,
+		queryDelete:   config.QueryDelete,
+		mirror:        config.Mirror,
+		maxMemory:     config.MaxMemory,
+		maxFileSize:   config.MaxFileSize,
+		maxBodySize:   config.MaxBodySize,
+		next:          next,
+		name:          name,
 	}, nil
 }
 
 func (a *Formdata) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if a.maxBodySize > 0 && req.Body != nil {
+		req.Body = http.MaxBytesReader(rw, req.Body, a.maxBodySize)
+	}
+
+	set, appendTo := a.expandSetAppend(req)
+	a.handleQuery(req, set, appendTo)
+
 	ct := req.Header.Get("Content-Type")
 	switch {
 	case strings.HasPrefix(ct, "application/x-www-form-urlencoded"):
-		a.handleURLEncoded(rw, req)
+		a.handleURLEncoded(rw, req, set, appendTo)
 	case strings.HasPrefix(ct, "multipart/form-data"):
-		a.handleMultipart(rw, req)
+		defer a.handleMultipart(rw, req, set, appendTo)()
 	}
 	a.next.ServeHTTP(rw, req)
 }
 
-// handleURLEncoded mutates application/x-www-form-urlencoded request bodies in-place.
-func (a *Formdata) handleURLEncoded(rw http.ResponseWriter, req *http.Request) {
+// handleQuery mutates the request URL's query parameters. It runs unconditionally,
+// independent of the request body's Content-Type, so it also applies to GET
+// requests. When Mirror is set, the body's delete list and the already
+// template-expanded set/appendTo maps are additionally applied to the query
+// string, so a templated value like "{{ .Header.X-Request-Id }}" is mirrored
+// as its expanded form rather than leaking template syntax into the URL.
+func (a *Formdata) handleQuery(req *http.Request, set, appendTo map[string]string) {
+	if len(a.querySet) == 0 && len(a.queryAppend) == 0 && len(a.queryDelete) == 0 && !a.mirror {
+		return
+	}
+
+	values := req.URL.Query()
+
+	for _, k := range a.queryDelete {
+		values.Del(k)
+	}
+	for k, v := range a.querySet {
+		values.Set(k, v)
+	}
+	for k, v := range a.queryAppend {
+		values.Add(k, v)
+	}
+
+	if a.mirror {
+		for _, k := range a.delete {
+			values.Del(k)
+		}
+		for k, v := range set {
+			values.Set(k, v)
+		}
+		for k, v := range appendTo {
+			values.Add(k, v)
+		}
+	}
+
+	req.URL.RawQuery = values.Encode()
+}
+
+// requestCtx is the data made available to Set/Append template expansion.
+// Header and Query expose a single value per key for straightforward
+// "{{ .Header.X-Request-Id }}"/"{{ .Query.foo }}" access; callers needing
+// multi-valued headers or query parameters should read the request directly.
+type requestCtx struct {
+	Header     map[string]string
+	Path       string
+	RemoteAddr string
+	Query      map[string]string
+}
+
+// Now formats the current time using the given time.Layout-style reference,
+// e.g. "{{ .Now \"2006-01-02\" }}".
+func (requestCtx) Now(layout string) string {
+	return time.Now().Format(layout)
+}
+
+// newRequestCtx builds a requestCtx from an incoming request.
+func newRequestCtx(req *http.Request) requestCtx {
+	header := make(map[string]string, len(req.Header))
+	for k := range req.Header {
+		header[k] = req.Header.Get(k)
+	}
+
+	query := make(map[string]string, len(req.URL.Query()))
+	for k, v := range req.URL.Query() {
+		if len(v) > 0 {
+			query[k] = v[0]
+		}
+	}
+
+	return requestCtx{
+		Header:     header,
+		Path:       req.URL.Path,
+		RemoteAddr: req.RemoteAddr,
+		Query:      query,
+	}
+}
+
+// headerAccessPattern matches the documented ".Header.KEY" dotted-access
+// syntax so that header names containing characters text/template cannot
+// parse as a field selector (most commonly "-", as in X-Request-Id) can
+// still be written the documented way.
+var headerAccessPattern = regexp.MustCompile(`\.Header\.([A-Za-z0-9][A-Za-z0-9_-]*)`)
+
+// rewriteHeaderAccess rewrites ".Header.KEY" into the equivalent, and
+// text/template-parseable, "(index .Header \"KEY\")".
+func rewriteHeaderAccess(s string) string {
+	return headerAccessPattern.ReplaceAllString(s, `(index .Header "$1")`)
+}
+
+// expandValue expands raw as a text/template against ctx, returning raw
+// unchanged if it contains no template delimiters or fails to parse or
+// execute. Expansion is a convenience, not a required input, so a malformed
+// template must never turn into a request error.
+func expandValue(raw string, ctx requestCtx) string {
+	if !strings.Contains(raw, "{{") {
+		return raw
+	}
+
+	tpl, err := template.New("value").Parse(rewriteHeaderAccess(raw))
+	if err != nil {
+		return raw
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, ctx); err != nil {
+		return raw
+	}
+	return buf.String()
+}
+
+// expandMap expands every value in values against ctx, returning values
+// unchanged when it is empty.
+func expandMap(values map[string]string, ctx requestCtx) map[string]string {
+	if len(values) == 0 {
+		return values
+	}
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = expandValue(v, ctx)
+	}
+	return out
+}
+
+// expandSetAppend evaluates req's requestCtx once and expands a.set and
+// a.appendTo against it, so templated values are resolved once per request
+// before being applied to the query string, the urlencoded body, or the
+// multipart body.
+func (a *Formdata) expandSetAppend(req *http.Request) (set, appendTo map[string]string) {
+	if len(a.set) == 0 && len(a.appendTo) == 0 {
+		return a.set, a.appendTo
+	}
+	ctx := newRequestCtx(req)
+	return expandMap(a.set, ctx), expandMap(a.appendTo, ctx)
+}
+
+// handleURLEncoded mutates application/x-www-form-urlencoded request bodies
+// in-place using the already template-expanded set and appendTo maps.
+func (a *Formdata) handleURLEncoded(rw http.ResponseWriter, req *http.Request, set, appendTo map[string]string) {
 	if err := req.ParseForm(); err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
+		http.Error(rw, err.Error(), statusForError(err))
 		return
 	}
 
@@ -77,10 +345,10 @@ func (a *Formdata) handleURLEncoded(rw http.ResponseWriter, req *http.Request) {
 	for _, k := range a.delete {
 		form.Del(k)
 	}
-	for k, v := range a.set {
+	for k, v := range set {
 		form.Set(k, v)
 	}
-	for k, v := range a.appendTo {
+	for k, v := range appendTo {
 		form.Add(k, v)
 	}
 
@@ -90,34 +358,46 @@ func (a *Formdata) handleURLEncoded(rw http.ResponseWriter, req *http.Request) {
 	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(encoded)), nil }
 }
 
-// handleMultipart mutates multipart/form-data request bodies while preserving file parts.
-func (a *Formdata) handleMultipart(rw http.ResponseWriter, req *http.Request) {
-	if err := req.ParseMultipartForm(32 << 20); err != nil { // 32MB memory threshold
-		http.Error(rw, err.Error(), http.StatusBadRequest)
-		return
+// noopCleanup is returned by handleMultipart's non-streaming branches, which
+// have nothing to close once next.ServeHTTP returns.
+func noopCleanup() {}
+
+// handleMultipart mutates multipart/form-data request bodies while preserving
+// file parts, using the already template-expanded set and appendTo maps.
+// MaxFileSize forces the buffered path even when Streaming is set, because
+// enforcing that ceiling with a clean 413 requires the body to be fully
+// parsed before next is called; see handleMultipartStreaming. The returned
+// func must be deferred by the caller so the streaming path's piped body is
+// closed once next.ServeHTTP returns, even if next never read it.
+func (a *Formdata) handleMultipart(rw http.ResponseWriter, req *http.Request, set, appendTo map[string]string) func() {
+	if a.streaming && a.maxFileSize <= 0 {
+		return a.handleMultipartStreaming(rw, req, set, appendTo)
 	}
-	m := req.MultipartForm
-	if m == nil {
-		return
+
+	values, rawFiles, err := parseMultipartBuffered(req, a.maxMemory, a.maxFileSize)
+	if err != nil {
+		http.Error(rw, err.Error(), statusForError(err))
+		return noopCleanup
 	}
 
-	// Apply operations to values
-	a.applyOpsToValues(m.Value)
+	// Apply operations to values and files
+	a.applyOpsToValues(values, set, appendTo)
+	files := a.applyOpsToFiles(rawFiles)
 
 	// Rebuild body
 	var body bytes.Buffer
 	writer := multipart.NewWriter(&body)
-	if err := writeValues(writer, m.Value); err != nil {
+	if err := writeValues(writer, values); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		return noopCleanup
 	}
-	if err := writeFiles(writer, m.File); err != nil {
+	if err := writeFiles(writer, files); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		return noopCleanup
 	}
 	if err := writer.Close(); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		return noopCleanup
 	}
 
 	req.Body = io.NopCloser(&body)
@@ -125,52 +405,411 @@ func (a *Formdata) handleMultipart(rw http.ResponseWriter, req *http.Request) {
 	req.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
 	snapshot := body.Bytes()
 	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(snapshot)), nil }
+	return noopCleanup
+}
+
+// valueField holds a text field's accumulated values together with the MIME header
+// of its first original part, so that header's Content-Type can be reapplied when
+// the body is rebuilt instead of falling back to a bare form field. Other header
+// fields are not reapplied.
+type valueField struct {
+	header textproto.MIMEHeader
+	values []string
+}
+
+// parseMultipartBuffered reads a multipart/form-data body into memory part by part,
+// recording each value field's original MIME header and each file's content, since
+// http.Request.ParseMultipartForm discards part headers once it builds its maps.
+// maxMemory bounds the total bytes buffered across all parts and maxFileSize bounds
+// any single file part; either set to zero disables that check. Each part's reader
+// itself is bounded by whichever ceiling applies, so a single oversized part is
+// rejected as it is read instead of being buffered in full first.
+func parseMultipartBuffered(req *http.Request, maxMemory, maxFileSize int64) (map[string]*valueField, map[string][]fileEntry, error) {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	boundary, ok := params["boundary"]
+	if !ok {
+		return nil, nil, fmt.Errorf("multipart: boundary not found")
+	}
+
+	values := make(map[string]*valueField)
+	files := make(map[string][]fileEntry)
+
+	var memoryUsed int64
+	reader := multipart.NewReader(req.Body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return values, files, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if maxMemory > 0 && memoryUsed >= maxMemory {
+			_ = part.Close()
+			return nil, nil, errRequestEntityTooLarge(fmt.Sprintf("multipart body exceeds maxMemory of %d bytes", maxMemory))
+		}
+
+		name := part.FormName()
+		filename := part.FileName()
+		header := part.Header
+		limit := partReadLimit(filename != "", maxFileSize, maxMemory, memoryUsed)
+		data, err := readPart(part, limit)
+		_ = part.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if filename != "" && maxFileSize > 0 && int64(len(data)) > maxFileSize {
+			return nil, nil, errRequestEntityTooLarge(fmt.Sprintf("file part %q exceeds maxFileSize of %d bytes", name, maxFileSize))
+		}
+
+		memoryUsed += int64(len(data))
+		if maxMemory > 0 && memoryUsed > maxMemory {
+			return nil, nil, errRequestEntityTooLarge(fmt.Sprintf("multipart body exceeds maxMemory of %d bytes", maxMemory))
+		}
+
+		if filename == "" {
+			vf := values[name]
+			if vf == nil {
+				vf = &valueField{header: header}
+				values[name] = vf
+			}
+			vf.values = append(vf.values, string(data))
+			continue
+		}
+
+		content := data
+		files[name] = append(files[name], fileEntry{
+			filename:    filename,
+			contentType: header.Get("Content-Type"),
+			open:        func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(content)), nil },
+		})
+	}
+}
+
+// partReadLimit returns the tightest positive byte ceiling a part's reader
+// should be bounded by: maxFileSize for file parts, and whatever maxMemory
+// budget remains for any part, so a single part can never be buffered past
+// either configured ceiling. Zero means unlimited.
+func partReadLimit(isFile bool, maxFileSize, maxMemory, memoryUsed int64) int64 {
+	var limit int64
+	if isFile {
+		limit = maxFileSize
+	}
+	if maxMemory > 0 {
+		remaining := maxMemory - memoryUsed
+		if limit <= 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+	return limit
+}
+
+// readPart reads a part's content bounded by limit bytes (zero means
+// unlimited), reading one byte past the limit so the caller can detect and
+// report the overage instead of silently truncating it.
+func readPart(part *multipart.Part, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(part)
+	}
+	return io.ReadAll(io.LimitReader(part, limit+1))
+}
+
+// errRequestEntityTooLarge marks a parse error that should surface as HTTP 413
+// rather than the default 400, because it results from a configured size ceiling.
+type errRequestEntityTooLarge string
+
+func (e errRequestEntityTooLarge) Error() string { return string(e) }
+
+// statusForError maps an error from request parsing to the HTTP status it should
+// produce: 413 for size-limit violations, 400 for anything else.
+func statusForError(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	var tooLarge errRequestEntityTooLarge
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// handleMultipartStreaming rewrites a multipart/form-data body part-by-part on an
+// io.Pipe instead of buffering the whole request in memory, using the already
+// template-expanded set and appendTo maps. Parts that are deleted or set are
+// dropped from the passthrough and the set/append values and files are
+// flushed as new parts once the original body has been fully read. The
+// returned func closes the pipe's read end; it must be deferred by the caller
+// after next.ServeHTTP returns, since io.Pipe writes block until read and
+// nothing else guarantees the writer goroutine's blocked write is ever
+// unblocked if the handler chain returns without fully reading the body.
+func (a *Formdata) handleMultipartStreaming(rw http.ResponseWriter, req *http.Request, set, appendTo map[string]string) func() {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return noopCleanup
+	}
+	boundary, ok := params["boundary"]
+	if !ok {
+		http.Error(rw, "multipart: boundary not found", http.StatusBadRequest)
+		return noopCleanup
+	}
+
+	body := req.Body
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		reader := multipart.NewReader(body, boundary)
+		err := a.streamParts(reader, writer, set)
+		if err == nil {
+			err = a.flushDeferredValues(writer, set, appendTo)
+		}
+		if err == nil {
+			err = a.flushDeferredFiles(writer)
+		}
+		if cerr := writer.Close(); err == nil {
+			err = cerr
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	req.Body = pr
+	req.ContentLength = -1
+	req.GetBody = nil
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
+	return func() { _ = pr.Close() }
+}
+
+// streamParts copies every part from reader to writer unbuffered, dropping parts
+// whose form name is deleted or set (those are flushed separately so that set
+// replaces rather than appends). handleMultipart only reaches the streaming
+// path when MaxFileSize is unset, so parts are copied straight through with no
+// size ceiling to enforce here.
+func (a *Formdata) streamParts(reader *multipart.Reader, writer *multipart.Writer, set map[string]string) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := part.FormName()
+		isFile := part.FileName() != ""
+		if a.dropPart(name, isFile, set) {
+			_ = part.Close()
+			continue
+		}
+
+		dst, err := writer.CreatePart(part.Header)
+		if err != nil {
+			_ = part.Close()
+			return err
+		}
+		if _, err := io.Copy(dst, part); err != nil {
+			_ = part.Close()
+			return err
+		}
+		_ = part.Close()
+	}
+}
+
+// dropPart reports whether a passed-through part should be dropped because it is
+// being deleted or replaced by a set operation. set is the already-expanded
+// form of a.set.
+func (a *Formdata) dropPart(name string, isFile bool, set map[string]string) bool {
+	if isFile {
+		_, isSet := a.setFiles[name]
+		return a.deleteFileSet[name] || isSet
+	}
+	_, isSet := set[name]
+	return a.deleteSet[name] || isSet
+}
+
+// flushDeferredValues writes the configured set and append fields as new parts
+// once the original body has been fully streamed through. set and appendTo
+// are the already-template-expanded forms of a.set and a.appendTo.
+func (a *Formdata) flushDeferredValues(writer *multipart.Writer, set, appendTo map[string]string) error {
+	for k, v := range set {
+		if err := writer.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+	for k, v := range appendTo {
+		if err := writer.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// applyOpsToValues applies delete, set, and append operations to the given values map.
-func (a *Formdata) applyOpsToValues(values map[string][]string) {
+// flushDeferredFiles writes the configured setFiles and appendFiles entries as new
+// parts once the original body has been fully streamed through.
+func (a *Formdata) flushDeferredFiles(writer *multipart.Writer) error {
+	for field, spec := range a.setFiles {
+		if err := writeFileEntry(writer, field, fileEntryFromSpec(spec)); err != nil {
+			return err
+		}
+	}
+	for field, spec := range a.appendFiles {
+		if err := writeFileEntry(writer, field, fileEntryFromSpec(spec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOpsToValues applies delete, set, and append operations to the given
+// values map. set and appendTo are the already-template-expanded forms of
+// a.set and a.appendTo.
+func (a *Formdata) applyOpsToValues(values map[string]*valueField, set, appendTo map[string]string) {
 	for _, k := range a.delete {
 		delete(values, k)
 	}
-	for k, v := range a.set {
-		values[k] = []string{v}
+	for k, v := range set {
+		values[k] = &valueField{values: []string{v}}
 	}
-	for k, v := range a.appendTo {
-		values[k] = append(values[k], v)
+	for k, v := range appendTo {
+		vf := values[k]
+		if vf == nil {
+			vf = &valueField{}
+			values[k] = vf
+		}
+		vf.values = append(vf.values, v)
 	}
 }
 
-// writeValues writes simple form values to a multipart writer.
-func writeValues(w *multipart.Writer, values map[string][]string) error {
-	for k, vals := range values {
-		for _, v := range vals {
-			if err := w.WriteField(k, v); err != nil {
-				return err
-			}
+// fileEntry is an internal representation of a file part that can be served either
+// from an original part's content buffered by parseMultipartBuffered or from a
+// FileSpec read from disk/inline,
+// so writeFiles can treat passthrough and injected files uniformly.
+type fileEntry struct {
+	filename    string
+	contentType string
+	open        func() (io.ReadCloser, error)
+}
+
+// applyOpsToFiles applies deleteFiles, setFiles, and appendFiles operations to the
+// given file entries, returning the resulting file entries to write.
+func (a *Formdata) applyOpsToFiles(files map[string][]fileEntry) map[string][]fileEntry {
+	out := make(map[string][]fileEntry, len(files))
+	for field, entries := range files {
+		if a.deleteFileSet[field] {
+			continue
 		}
+		if _, ok := a.setFiles[field]; ok {
+			continue
+		}
+		out[field] = entries
 	}
-	return nil
+	for field, spec := range a.setFiles {
+		out[field] = []fileEntry{fileEntryFromSpec(spec)}
+	}
+	for field, spec := range a.appendFiles {
+		out[field] = append(out[field], fileEntryFromSpec(spec))
+	}
+	return out
 }
 
-// writeFiles writes file fields to a multipart writer.
-func writeFiles(w *multipart.Writer, files map[string][]*multipart.FileHeader) error {
-	for field, fhs := range files {
-		for _, fh := range fhs {
-			f, err := fh.Open()
-			if err != nil {
-				return err
+// fileEntryFromSpec builds a fileEntry that serves its content from disk or from an
+// inline byte slice, per the given FileSpec.
+func fileEntryFromSpec(spec FileSpec) fileEntry {
+	contentType := spec.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return fileEntry{
+		filename:    spec.Filename,
+		contentType: contentType,
+		open: func() (io.ReadCloser, error) {
+			if spec.Inline != nil {
+				return io.NopCloser(bytes.NewReader(spec.Inline)), nil
 			}
-			part, err := w.CreateFormFile(field, fh.Filename)
-			if err != nil {
-				_ = f.Close()
+			return os.Open(spec.Path)
+		},
+	}
+}
+
+// writeValues writes simple form values to a multipart writer, reusing each
+// field's original Content-Type when one was recorded.
+func writeValues(w *multipart.Writer, values map[string]*valueField) error {
+	for name, vf := range values {
+		for _, v := range vf.values {
+			if err := writeValuePart(w, name, vf.header, v); err != nil {
 				return err
 			}
-			if _, err := io.Copy(part, f); err != nil {
-				_ = f.Close()
+		}
+	}
+	return nil
+}
+
+// writeValuePart writes a single text field value. When the original part carried
+// a Content-Type, it is preserved via CreatePart; otherwise the field falls back to
+// a bare form field, as is the case for values injected via Set or appended to a
+// field absent from the original body. Values appended to an existing field reuse
+// that field's recorded Content-Type.
+func writeValuePart(w *multipart.Writer, name string, header textproto.MIMEHeader, value string) error {
+	var part io.Writer
+	var err error
+	if ct := header.Get("Content-Type"); ct != "" {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, escapeQuotes(name)))
+		h.Set("Content-Type", ct)
+		part, err = w.CreatePart(h)
+	} else {
+		part, err = w.CreateFormField(name)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(part, value)
+	return err
+}
+
+// writeFiles writes file fields to a multipart writer, honoring each entry's
+// declared Content-Type instead of always falling back to application/octet-stream.
+func writeFiles(w *multipart.Writer, files map[string][]fileEntry) error {
+	for field, entries := range files {
+		for _, entry := range entries {
+			if err := writeFileEntry(w, field, entry); err != nil {
 				return err
 			}
-			_ = f.Close()
 		}
 	}
 	return nil
 }
+
+// writeFileEntry opens a single file entry and copies it into a new part carrying
+// an explicit Content-Disposition and Content-Type header.
+func writeFileEntry(w *multipart.Writer, field string, entry fileEntry) error {
+	f, err := entry.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(field), escapeQuotes(entry.filename)))
+	header.Set("Content-Type", entry.contentType)
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// escapeQuotes mirrors the quoting mime/multipart applies to Content-Disposition
+// parameters so synthesized headers round-trip the same way as parsed ones.
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
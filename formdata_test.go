@@ -3,13 +3,16 @@ package formdata
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 // nextHandler captures the request seen downstream for assertions.
@@ -18,10 +21,6 @@ type nextHandler struct {
 }
 
 func (h *nextHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	// Read the body fully so it can be re-used by tests if needed
-	if r.Body != nil {
-		_, _ = io.ReadAll(r.Body)
-	}
 	h.req = r
 	rw.WriteHeader(http.StatusOK)
 }
@@ -142,6 +141,26 @@ func TestNew_EmptyConfigError(t *testing.T) {
 	}
 }
 
+func TestNew_SetFilesBadPathError(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SetFiles["avatar"] = FileSpec{Path: "/nonexistent/does-not-exist.png"}
+	next := &nextHandler{}
+	_, err := New(context.Background(), next, cfg, "test")
+	if err == nil {
+		t.Fatalf("expected error for a setFiles entry with an unreadable path, got nil")
+	}
+}
+
+func TestNew_AppendFilesMissingPathAndInlineError(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AppendFiles["extra"] = FileSpec{Filename: "sig.txt"}
+	next := &nextHandler{}
+	_, err := New(context.Background(), next, cfg, "test")
+	if err == nil {
+		t.Fatalf("expected error for an appendFiles entry with neither path nor inline set, got nil")
+	}
+}
+
 func TestServeHTTP_URLEncoded_FormMutations(t *testing.T) {
 	cfg := &Config{
 		Delete: []string{"a"},
@@ -271,3 +290,655 @@ func TestServeHTTP_Multipart_FilePreserved(t *testing.T) {
 		t.Fatalf("replayed body empty")
 	}
 }
+
+// multipartCapture parses the downstream multipart body itself (rather than just
+// draining it) so streaming tests can inspect the rewritten parts.
+type multipartCapture struct {
+	req *http.Request
+	m   *multipart.Form
+}
+
+func (h *multipartCapture) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.req = r
+	if err := r.ParseMultipartForm(32 << 20); err == nil {
+		h.m = r.MultipartForm
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func TestServeHTTP_Multipart_Streaming_ValuesAndFiles(t *testing.T) {
+	cfg := &Config{
+		Streaming: true,
+		Delete:    []string{"a"},
+		Set:       map[string]string{"b": "y"},
+		Append:    map[string]string{"d": "q"},
+	}
+	next := &multipartCapture{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if werr := mw.WriteField("a", "1"); werr != nil {
+		t.Fatalf("write field: %v", werr)
+	}
+	if werr := mw.WriteField("b", "x"); werr != nil {
+		t.Fatalf("write field: %v", werr)
+	}
+	fw, err := mw.CreateFormFile("file", "hello.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := fw.Write([]byte("hello world")); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close mw: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+	req.ContentLength = int64(buf.Len())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+
+	if next.req.GetBody != nil {
+		t.Fatalf("expected GetBody to be nil for a streamed body")
+	}
+	if next.m == nil {
+		t.Fatalf("downstream MultipartForm nil")
+	}
+	if _, ok := next.m.Value["a"]; ok {
+		t.Fatalf("expected 'a' deleted")
+	}
+	assertMultipartValues(t, next.m.Value, "b", []string{"y"})
+	assertMultipartValues(t, next.m.Value, "d", []string{"q"})
+	assertFilePreserved(t, next.m.File, "file", "hello world")
+}
+
+// rejectingHandler rejects the request without ever touching req.Body, the
+// way an auth or size check further down a middleware chain ordinarily would.
+type rejectingHandler struct {
+	req *http.Request
+}
+
+func (h *rejectingHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.req = r
+	rw.WriteHeader(http.StatusForbidden)
+}
+
+func TestServeHTTP_Multipart_Streaming_DownstreamNeverReadsBody(t *testing.T) {
+	cfg := &Config{Streaming: true, Set: map[string]string{"b": "y"}}
+	next := &rejectingHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("a", "1"); err != nil {
+		t.Fatalf("WriteField: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close mw: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	done := make(chan struct{})
+	rec := httptest.NewRecorder()
+	go func() {
+		h.ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ServeHTTP did not return")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+
+	if next.req == nil {
+		t.Fatalf("downstream request not captured")
+	}
+	// The plugin must close the piped body itself once next.ServeHTTP returns,
+	// even though next never read it, or the background goroutine writing to
+	// the other end of the pipe leaks forever blocked on an unconsumed write.
+	_, err = next.req.Body.Read(make([]byte, 1))
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected the piped body to already be closed, got %v", err)
+	}
+}
+
+func TestServeHTTP_Multipart_Streaming_FileOps(t *testing.T) {
+	cfg := &Config{
+		Streaming:   true,
+		DeleteFiles: []string{"old"},
+		SetFiles: map[string]FileSpec{
+			"avatar": {Filename: "new.png", ContentType: "image/png", Inline: []byte("new-avatar")},
+		},
+		AppendFiles: map[string]FileSpec{
+			"extra": {Filename: "sig.txt", ContentType: "text/plain", Inline: []byte("signature")},
+		},
+	}
+	next := &multipartCapture{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	oldPart, err := mw.CreateFormFile("old", "old.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := oldPart.Write([]byte("stale")); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	avatarPart, err := mw.CreateFormFile("avatar", "original.png")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := avatarPart.Write([]byte("original-avatar")); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close mw: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+	req.ContentLength = int64(buf.Len())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+
+	if next.m == nil {
+		t.Fatalf("downstream MultipartForm nil")
+	}
+	if _, ok := next.m.File["old"]; ok {
+		t.Fatalf("expected 'old' file field deleted")
+	}
+	assertFilePreserved(t, next.m.File, "avatar", "new-avatar")
+	assertFilePreserved(t, next.m.File, "extra", "signature")
+}
+
+func TestServeHTTP_Multipart_PreservesOriginalContentTypes(t *testing.T) {
+	cfg := &Config{Set: map[string]string{"untouched": "1"}}
+
+	var gotValues map[string]*valueField
+	var gotFiles map[string][]fileEntry
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var err error
+		gotValues, gotFiles, err = parseMultipartBuffered(r, 0, 0)
+		if err != nil {
+			t.Fatalf("parseMultipartBuffered downstream: %v", err)
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	textHeader := textproto.MIMEHeader{}
+	textHeader.Set("Content-Disposition", `form-data; name="bio"`)
+	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
+	tp, err := mw.CreatePart(textHeader)
+	if err != nil {
+		t.Fatalf("CreatePart: %v", err)
+	}
+	if _, err := tp.Write([]byte("héllo")); err != nil {
+		t.Fatalf("write text part: %v", err)
+	}
+
+	fileHeader := textproto.MIMEHeader{}
+	fileHeader.Set("Content-Disposition", `form-data; name="avatar"; filename="pic.png"`)
+	fileHeader.Set("Content-Type", "image/png")
+	fp, err := mw.CreatePart(fileHeader)
+	if err != nil {
+		t.Fatalf("CreatePart: %v", err)
+	}
+	if _, err := fp.Write([]byte{0x89, 'P', 'N', 'G'}); err != nil {
+		t.Fatalf("write file part: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close mw: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+	req.ContentLength = int64(buf.Len())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+
+	bio := gotValues["bio"]
+	if bio == nil || bio.header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("expected utf-8 content-type preserved, got %#v", bio)
+	}
+	if len(bio.values) != 1 || bio.values[0] != "héllo" {
+		t.Fatalf("unexpected bio value: %#v", bio)
+	}
+
+	avatarFiles := gotFiles["avatar"]
+	if len(avatarFiles) != 1 || avatarFiles[0].contentType != "image/png" {
+		t.Fatalf("expected image/png content-type preserved, got %#v", avatarFiles)
+	}
+}
+
+func TestServeHTTP_QueryMutations_GetRequest(t *testing.T) {
+	cfg := &Config{
+		QueryDelete: []string{"a"},
+		QuerySet:    map[string]string{"b": "y"},
+		QueryAppend: map[string]string{"c": "q"},
+	}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example/path?a=1&b=x&c=p", nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+
+	down := mustDownstream(t, next)
+	q := down.URL.Query()
+	assertNoKey(t, q, "a")
+	if q.Get("b") != "y" {
+		t.Fatalf("unexpected b: %q", q.Get("b"))
+	}
+	assertPostFormEquals(t, q, "c", []string{"p", "q"})
+}
+
+func TestServeHTTP_QueryMutations_Mirror(t *testing.T) {
+	cfg := &Config{
+		Delete: []string{"a"},
+		Set:    map[string]string{"b": "y"},
+		Mirror: true,
+	}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("a", "1")
+	form.Set("b", "x")
+	body := form.Encode()
+	req := httptest.NewRequest(http.MethodPost, "http://example/path?a=1&b=x", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ContentLength = int64(len(body))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+
+	down := mustDownstream(t, next)
+	q := down.URL.Query()
+	assertNoKey(t, q, "a")
+	if q.Get("b") != "y" {
+		t.Fatalf("unexpected mirrored query b: %q", q.Get("b"))
+	}
+	mustParseForm(t, down)
+	if down.PostForm.Get("b") != "y" {
+		t.Fatalf("unexpected body b: %q", down.PostForm.Get("b"))
+	}
+}
+
+func TestServeHTTP_Multipart_MaxFileSizeRejected(t *testing.T) {
+	cfg := &Config{Set: map[string]string{"untouched": "1"}, MaxFileSize: 4}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "big.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := fw.Write([]byte("too big")); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close mw: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+	req.ContentLength = int64(buf.Len())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTP_Multipart_MaxFileSizeRejected_DefaultStreamingConfig(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Set["untouched"] = "1"
+	cfg.MaxFileSize = 4
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "big.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := fw.Write([]byte("this is 17 bytes!")); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close mw: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+	req.ContentLength = int64(buf.Len())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 from the default (streaming) config, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTP_Multipart_MaxMemoryRejected(t *testing.T) {
+	cfg := &Config{Set: map[string]string{"untouched": "1"}, MaxMemory: 4}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("a", "too long for the budget"); err != nil {
+		t.Fatalf("write field: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close mw: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+	req.ContentLength = int64(buf.Len())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTP_Multipart_MaxMemoryRejected_UnlimitedMaxFileSize(t *testing.T) {
+	cfg := &Config{Set: map[string]string{"untouched": "1"}, MaxMemory: 4}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "big.bin")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := fw.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close mw: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+	req.ContentLength = int64(buf.Len())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for an oversized file with unlimited MaxFileSize but a small MaxMemory budget, got %d", rec.Code)
+	}
+}
+
+func TestPartReadLimit(t *testing.T) {
+	cases := []struct {
+		name                                      string
+		isFile                                    bool
+		maxFileSize, maxMemory, memoryUsed, expect int64
+	}{
+		{"both unlimited", false, 0, 0, 0, 0},
+		{"file bounded by maxFileSize only", true, 10, 0, 0, 10},
+		{"value bounded by remaining maxMemory", false, 0, 100, 60, 40},
+		{"file bounded by the tighter of maxFileSize and remaining maxMemory", true, 50, 100, 80, 20},
+		{"file bounded by maxFileSize when the memory budget is looser", true, 10, 100, 0, 10},
+	}
+	for _, c := range cases {
+		if got := partReadLimit(c.isFile, c.maxFileSize, c.maxMemory, c.memoryUsed); got != c.expect {
+			t.Fatalf("%s: got %d want %d", c.name, got, c.expect)
+		}
+	}
+}
+
+func TestServeHTTP_URLEncoded_MaxBodySizeRejected(t *testing.T) {
+	cfg := &Config{Set: map[string]string{"b": "y"}, MaxBodySize: 4}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("a", "this is way too long")
+	body := form.Encode()
+	req := httptest.NewRequest(http.MethodPost, "http://example/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ContentLength = int64(len(body))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTP_URLEncoded_TemplateExpansion(t *testing.T) {
+	cfg := &Config{
+		Set: map[string]string{
+			"path":    "{{ .Path }}",
+			"addr":    "{{ .RemoteAddr }}",
+			"reqid":   "{{ .Header.X-Request-Id }}",
+			"query":   "{{ .Query.foo }}",
+			"literal": "just-a-string",
+		},
+	}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	form := url.Values{}
+	body := form.Encode()
+	req := httptest.NewRequest(http.MethodPost, "http://example/form?foo=bar", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Request-Id", "abc123")
+	req.ContentLength = int64(len(body))
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+
+	down := mustDownstream(t, next)
+	mustParseForm(t, down)
+	if got := down.PostForm.Get("path"); got != "/form" {
+		t.Fatalf("unexpected path: %q", got)
+	}
+	if got := down.PostForm.Get("addr"); got != "10.0.0.1:1234" {
+		t.Fatalf("unexpected addr: %q", got)
+	}
+	if got := down.PostForm.Get("reqid"); got != "abc123" {
+		t.Fatalf("unexpected reqid: %q", got)
+	}
+	if got := down.PostForm.Get("query"); got != "bar" {
+		t.Fatalf("unexpected query: %q", got)
+	}
+	if got := down.PostForm.Get("literal"); got != "just-a-string" {
+		t.Fatalf("unexpected literal: %q", got)
+	}
+}
+
+func TestServeHTTP_Multipart_TemplateExpansion(t *testing.T) {
+	cfg := &Config{
+		Streaming: false,
+		Set:       map[string]string{"reqid": "{{ .Header.X-Request-Id }}"},
+		Append:    map[string]string{"path": "{{ .Path }}"},
+	}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("keep", "v"); err != nil {
+		t.Fatalf("WriteField: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-Request-Id", "xyz789")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+
+	down := mustDownstream(t, next)
+	form := mustParseMultipart(t, down)
+	assertMultipartValues(t, form.Value, "reqid", []string{"xyz789"})
+	assertMultipartValues(t, form.Value, "path", []string{"/upload"})
+}
+
+func TestServeHTTP_Multipart_Streaming_TemplateExpansion(t *testing.T) {
+	cfg := &Config{
+		Streaming: true,
+		Set:       map[string]string{"reqid": "{{ .Header.X-Request-Id }}"},
+	}
+	next := &multipartCapture{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("keep", "v"); err != nil {
+		t.Fatalf("WriteField: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-Request-Id", "stream-1")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+	assertMultipartValues(t, next.m.Value, "reqid", []string{"stream-1"})
+}
+
+func TestExpandValue_MalformedTemplateFallsThroughAsLiteral(t *testing.T) {
+	ctx := requestCtx{Header: map[string]string{"X-Request-Id": "abc"}, Path: "/p"}
+
+	malformed := []string{
+		"{{",
+		"{{ .Path",
+		"{{ .Header.X-Request-Id",
+		"{{ .Nonexistent.Field }}",
+		"{{ range }}",
+		"{{ .Now }}",
+		"{{ .Path | nosuchfunc }}",
+	}
+	for _, raw := range malformed {
+		if got := expandValue(raw, ctx); got != raw {
+			t.Fatalf("expected malformed template %q to fall through unchanged, got %q", raw, got)
+		}
+	}
+}
+
+func TestServeHTTP_QueryMutations_MirrorExpandsTemplates(t *testing.T) {
+	cfg := &Config{
+		Set:    map[string]string{"token": "{{ .Header.X-Request-Id }}"},
+		Mirror: true,
+	}
+	next := &nextHandler{}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	form := url.Values{}
+	body := form.Encode()
+	req := httptest.NewRequest(http.MethodPost, "http://example/form", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Request-Id", "real-id-123")
+	req.ContentLength = int64(len(body))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertStatusOK(t, rec)
+
+	down := mustDownstream(t, next)
+	if got := down.URL.Query().Get("token"); got != "real-id-123" {
+		t.Fatalf("unexpected mirrored query token: %q", got)
+	}
+	mustParseForm(t, down)
+	if got := down.PostForm.Get("token"); got != "real-id-123" {
+		t.Fatalf("unexpected body token: %q", got)
+	}
+}
+
+func TestExpandValue_Now(t *testing.T) {
+	ctx := requestCtx{}
+	got := expandValue(`{{ .Now "2006" }}`, ctx)
+	if len(got) != 4 {
+		t.Fatalf("unexpected Now expansion: %q", got)
+	}
+}